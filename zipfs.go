@@ -2,21 +2,49 @@ package zipfs
 
 import (
 	"archive/zip"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
 	"encoding/binary"
 	"errors"
 	"io"
+	iofs "io/fs"
 	"net/http"
 	"os"
+	"path"
 	"strings"
 	"time"
 )
 
+// AllowInsecurePaths disables the archive entry path validation zipFS
+// normally performs. Leave this false unless the archive is trusted and
+// relies on entries ErrInsecurePath would otherwise reject.
+var AllowInsecurePaths = false
+
+// ErrInsecurePath is returned by Open when name is an archive entry whose
+// name escaped the archive root, e.g. "../foo", an absolute path, or a
+// backslash-separated Windows path. Such entries are excluded from the file
+// system entirely (they never appear in a directory listing); opening their
+// exact original path returns ErrInsecurePath instead of the usual
+// "file does not exist" error. Opening any other, unrelated path is
+// unaffected.
+var ErrInsecurePath = errors.New("zipfs: archive contains insecure entry paths")
+
 // New creates a new zip file system. The specified name must correspond
 // to a name used in a zipfs: comment. If the zipfs command has already
 // been run on the executable, the zipped data is being read from there,
 // otherwise (e.g. during development) it is being read from the specified
 // directory.
 func New(name string, dir string) http.FileSystem {
+	return http.FS(NewFS(name, dir))
+}
+
+// NewFS is the io/fs analogue of New: it creates a file system for the
+// same named collection, exposed through fs.FS (and the optional
+// fs.ReadDirFS, fs.StatFS, fs.ReadFileFS and fs.SubFS interfaces) instead
+// of http.FileSystem. New is implemented in terms of NewFS via http.FS.
+func NewFS(name string, dir string) iofs.FS {
 	return &gatewayFS{
 		name: name,
 		dir:  dir,
@@ -26,86 +54,212 @@ func New(name string, dir string) http.FileSystem {
 type gatewayFS struct {
 	name string
 	dir  string
-	fs   http.FileSystem
+	fs   iofs.FS
 }
 
-func (gs *gatewayFS) Open(name string) (http.File, error) {
+func (gs *gatewayFS) resolve() iofs.FS {
 	if gs.fs == nil {
 		zip := gs.openZipFile(gs.name)
 		if zip == nil {
-			gs.fs = http.Dir(gs.dir)
+			gs.fs = os.DirFS(gs.dir)
 		} else {
-			gs.fs = &zipFS{zip: zip}
+			gs.fs = newZipFS(zip)
 		}
 	}
-	return gs.fs.Open(name)
+	return gs.fs
 }
 
-func (gs *gatewayFS) openZipFile(name string) *zip.Reader {
-	name = name + "\x00"
-	nameBuffer := make([]byte, len(name))
+func (gs *gatewayFS) Open(name string) (iofs.File, error) {
+	return gs.resolve().Open(name)
+}
+
+func (gs *gatewayFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	return iofs.ReadDir(gs.resolve(), name)
+}
 
+func (gs *gatewayFS) Stat(name string) (iofs.FileInfo, error) {
+	return iofs.Stat(gs.resolve(), name)
+}
+
+func (gs *gatewayFS) ReadFile(name string) ([]byte, error) {
+	return iofs.ReadFile(gs.resolve(), name)
+}
+
+func (gs *gatewayFS) Sub(dir string) (iofs.FS, error) {
+	return iofs.Sub(gs.resolve(), dir)
+}
+
+// openZipFile locates the named collection's zip data, trying each locator
+// in turn: the section embedding is checked first since it survives
+// re-signing tools that rewrite or strip the executable's tail, falling
+// back to the original tail trailer used by earlier zipfs builds.
+func (gs *gatewayFS) openZipFile(name string) *zip.Reader {
 	f, err := os.Open(os.Args[0])
 	if err != nil {
 		return nil
 	}
 
-	endOffset, err := f.Seek(-8, os.SEEK_END)
+	offset, length, err := (sectionLocator{}).locate(f, name)
 	if err != nil {
+		offset, length, err = (tailLocator{}).locate(f, name)
+	}
+	if err != nil {
+		f.Close()
+		return nil
+	}
+
+	zr, err := zip.NewReader(&offsetReader{
+		r:      f,
+		offset: offset,
+	}, length)
+	if err != nil {
+		f.Close()
 		return nil
 	}
 
-	var offset int64
+	return zr
+}
+
+// tailLocator finds a collection's zip data by reading the trailer the
+// zipfs command appends after the executable's natural end. Each trailer
+// is 8 bytes: the tag "ZIPR" followed by the big-endian file offset at
+// which that collection's name and zip data begin; trailers chain
+// backwards to the previous collection's trailer when the name doesn't
+// match, since a single run of the zipfs command can append more than one
+// collection.
+type tailLocator struct{}
+
+func (tailLocator) locate(f *os.File, name string) (offset int64, length int64, err error) {
+	lookup := name + "\x00"
+	nameBuffer := make([]byte, len(lookup))
+
+	endOffset, err := f.Seek(-8, os.SEEK_END)
+	if err != nil {
+		return 0, 0, err
+	}
+
 	for {
 		var block struct {
 			Tag    [4]byte
 			Offset int32
 		}
 
-		err = binary.Read(f, binary.BigEndian, &block)
-		if err != nil {
-			return nil
+		if err := binary.Read(f, binary.BigEndian, &block); err != nil {
+			return 0, 0, err
 		}
 
 		if string(block.Tag[:]) != "ZIPR" {
-			return nil
+			return 0, 0, errors.New("zipfs: no zip trailer found")
 		}
 
-		_, err = f.Seek(int64(block.Offset), os.SEEK_SET)
-		if err != nil {
-			return nil
+		if _, err := f.Seek(int64(block.Offset), os.SEEK_SET); err != nil {
+			return 0, 0, err
 		}
 
-		_, err := f.Read(nameBuffer)
-		if err != nil {
-			return nil
+		if _, err := f.Read(nameBuffer); err != nil {
+			return 0, 0, err
 		}
 
-		if string(nameBuffer) == name {
-			offset, _ = f.Seek(0, os.SEEK_CUR)
+		if string(nameBuffer) == lookup {
+			offset, err = f.Seek(0, os.SEEK_CUR)
+			if err != nil {
+				return 0, 0, err
+			}
 			break
 		}
 
 		endOffset, err = f.Seek(int64(block.Offset-8), os.SEEK_SET)
 		if err != nil {
-			return nil
+			return 0, 0, err
 		}
 	}
 
 	if offset == 0 {
-		return nil
+		return 0, 0, errors.New("zipfs: no zip trailer found")
 	}
 
-	zip, err := zip.NewReader(&offsetReader{
-		r:      f,
-		offset: offset,
-	}, endOffset-offset)
-	if err != nil {
-		f.Close()
-		return nil
+	return offset, endOffset - offset, nil
+}
+
+// elfSectionName, peSectionName and machoSegmentName are the section (or,
+// for Mach-O, segment) names the zipfs command writes collections into
+// when embedding via sectionLocator instead of appending to the tail.
+const (
+	elfSectionName   = ".zipfs"
+	peSectionName    = ".zipfs"
+	machoSegmentName = "__zipfs"
+)
+
+// sectionLocator finds a collection's zip data in a dedicated section of
+// the running executable, written there by the zipfs command as an
+// alternative to appending to the tail. Embedding this way survives tools
+// that rewrite or move trailing data, notably macOS codesign and Windows
+// Authenticode. Each matching section holds exactly one collection, framed
+// as "ZIPR"<collection-name>"\x00"<zip bytes>, so a binary with several
+// collections has one section per collection.
+type sectionLocator struct{}
+
+func (sectionLocator) locate(f *os.File, name string) (offset int64, length int64, err error) {
+	if ef, err := elf.NewFile(f); err == nil {
+		for _, sec := range ef.Sections {
+			if sec.Name != elfSectionName {
+				continue
+			}
+			if offset, length, ok, err := matchSectionHeader(f, int64(sec.Offset), int64(sec.Size), name); err != nil {
+				return 0, 0, err
+			} else if ok {
+				return offset, length, nil
+			}
+		}
 	}
 
-	return zip
+	if pf, err := pe.NewFile(f); err == nil {
+		for _, sec := range pf.Sections {
+			if sec.Name != peSectionName {
+				continue
+			}
+			if offset, length, ok, err := matchSectionHeader(f, int64(sec.Offset), int64(sec.Size), name); err != nil {
+				return 0, 0, err
+			} else if ok {
+				return offset, length, nil
+			}
+		}
+	}
+
+	if mf, err := macho.NewFile(f); err == nil {
+		for _, sec := range mf.Sections {
+			if sec.Seg != machoSegmentName {
+				continue
+			}
+			if offset, length, ok, err := matchSectionHeader(f, int64(sec.Offset), int64(sec.Size), name); err != nil {
+				return 0, 0, err
+			} else if ok {
+				return offset, length, nil
+			}
+		}
+	}
+
+	return 0, 0, errors.New("zipfs: no embedded section found")
+}
+
+// matchSectionHeader reads the "ZIPR"<name>"\x00" header a candidate
+// section should start with and, on a match, returns the file offset and
+// length of the zip data that follows it.
+func matchSectionHeader(r io.ReaderAt, secOffset int64, secSize int64, name string) (offset int64, length int64, ok bool, err error) {
+	header := []byte("ZIPR" + name + "\x00")
+	if int64(len(header)) > secSize {
+		return 0, 0, false, nil
+	}
+
+	buf := make([]byte, len(header))
+	if _, err := r.ReadAt(buf, secOffset); err != nil {
+		return 0, 0, false, err
+	}
+	if !bytes.Equal(buf, header) {
+		return 0, 0, false, nil
+	}
+
+	return secOffset + int64(len(header)), secSize - int64(len(header)), true, nil
 }
 
 type offsetReader struct {
@@ -118,24 +272,140 @@ func (r *offsetReader) ReadAt(b []byte, off int64) (n int, err error) {
 }
 
 type zipFS struct {
-	zip *zip.Reader
+	zip   *zip.Reader
+	dirs  map[string][]os.FileInfo
+	files map[string]*zip.File
+
+	// insecureNames records the cleaned path of every archive entry
+	// excluded by buildIndex for failing validEntryName, so Open can tell
+	// "doesn't exist" apart from "excluded for being insecure" without
+	// affecting any other, unrelated path. It is populated once by
+	// buildIndex before the zipFS is returned to the caller and never
+	// written again, so concurrent Open calls need no extra locking.
+	insecureNames map[string]bool
+}
+
+// newZipFS builds a zipFS and, along with it, a directory index that maps
+// each cleaned directory path found in the archive (the root directory
+// being "") to the FileInfo of its immediate children. This is what lets
+// Open recognize directory paths and answer ReadDir calls against them.
+func newZipFS(zr *zip.Reader) *zipFS {
+	fs := &zipFS{
+		zip:           zr,
+		dirs:          make(map[string][]os.FileInfo),
+		files:         make(map[string]*zip.File),
+		insecureNames: make(map[string]bool),
+	}
+	fs.buildIndex()
+	return fs
 }
 
-func (fs *zipFS) Open(name string) (http.File, error) {
-	name = strings.TrimLeft(name, "/")
+func (fs *zipFS) buildIndex() {
+	seen := map[string]bool{"": true}
 	for _, file := range fs.zip.File {
-		if file.Name == name {
-			return &zipFile{
-				file: file,
-			}, nil
+		name := strings.TrimSuffix(file.Name, "/")
+		if name == "" {
+			continue
+		}
+		if !AllowInsecurePaths && !validEntryName(name) {
+			fs.insecureNames[cleanPath(name)] = true
+			continue
+		}
+
+		parts := strings.Split(name, "/")
+		for i := 1; i < len(parts); i++ {
+			dir := strings.Join(parts[:i], "/")
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			parent := strings.Join(parts[:i-1], "/")
+			fs.dirs[parent] = append(fs.dirs[parent], &dirInfo{
+				name:    parts[i-1],
+				modTime: file.ModTime(),
+			})
+		}
+		if !file.FileInfo().IsDir() {
+			parent := strings.Join(parts[:len(parts)-1], "/")
+			fs.dirs[parent] = append(fs.dirs[parent], file.FileInfo())
+			fs.files[name] = file
 		}
 	}
-	return nil, errors.New("File not found")
 }
 
+// validEntryName reports whether name is safe to expose as an archive
+// path: relative, slash-separated, and free of "." / ".." components that
+// could walk outside the archive root once joined by a caller.
+func validEntryName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return false
+	}
+	if strings.ContainsAny(name, `\`+"\x00") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (fs *zipFS) Open(name string) (iofs.File, error) {
+	cleaned := cleanPath(name)
+	if children, ok := fs.dirs[cleaned]; ok || cleaned == "" {
+		return &zipFile{
+			name:     path.Base("/" + cleaned),
+			isDir:    true,
+			children: children,
+		}, nil
+	}
+	if file, ok := fs.files[cleaned]; ok {
+		return &zipFile{
+			file: file,
+		}, nil
+	}
+	if fs.insecureNames[cleaned] {
+		return nil, ErrInsecurePath
+	}
+	return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+}
+
+// cleanPath turns an http.FileSystem-style request path into the slash
+// separated, leading-slash-free form used as keys in zipFS.dirs and as
+// zip.File names ("" refers to the archive root).
+func cleanPath(name string) string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "." {
+		return ""
+	}
+	return cleaned
+}
+
+// dirInfo is the synthetic os.FileInfo used for directories, which have no
+// corresponding entry in the zip archive.
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (d *dirInfo) Name() string       { return d.name }
+func (d *dirInfo) Size() int64        { return 0 }
+func (d *dirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (d *dirInfo) ModTime() time.Time { return d.modTime }
+func (d *dirInfo) IsDir() bool        { return true }
+func (d *dirInfo) Sys() interface{}   { return nil }
+
 type zipFile struct {
 	file *zip.File
 	rc   io.ReadCloser
+	pos  int64
+	raw  *io.SectionReader
+
+	name     string
+	isDir    bool
+	children []os.FileInfo
+	dirPos   int
 }
 
 func (f *zipFile) Close() error {
@@ -150,6 +420,16 @@ func (f *zipFile) Close() error {
 }
 
 func (f *zipFile) Read(p []byte) (n int, err error) {
+	if f.isDir {
+		return 0, errors.New("zipfs: is a directory")
+	}
+
+	if f.raw != nil {
+		n, err = f.raw.ReadAt(p, f.pos)
+		f.pos += int64(n)
+		return n, err
+	}
+
 	if f.rc == nil {
 		rc, err := f.file.Open()
 		if err != nil {
@@ -157,16 +437,123 @@ func (f *zipFile) Read(p []byte) (n int, err error) {
 		}
 		f.rc = rc
 	}
-	return f.rc.Read(p)
+
+	n, err = f.rc.Read(p)
+	f.pos += int64(n)
+	return n, err
 }
 
-func (f *zipFile) Readdir(count int) ([]os.FileInfo, error) {
-	var list []os.FileInfo
-	return list, nil
+// ReadDir implements fs.ReadDirFile, walking the directory's child index
+// built by buildIndex so that fs.WalkDir and fs.ReadDir work against a zipFS.
+func (f *zipFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !f.isDir {
+		return nil, errors.New("not a directory")
+	}
+
+	if n <= 0 {
+		list := f.children[f.dirPos:]
+		f.dirPos = len(f.children)
+		return childDirEntries(list), nil
+	}
+
+	if f.dirPos >= len(f.children) {
+		return nil, io.EOF
+	}
+
+	end := f.dirPos + n
+	if end > len(f.children) {
+		end = len(f.children)
+	}
+	list := f.children[f.dirPos:end]
+	f.dirPos = end
+	return childDirEntries(list), nil
+}
+
+// childDirEntries adapts the os.FileInfo children built by buildIndex to
+// the fs.DirEntry values fs.ReadDirFile callers expect.
+func childDirEntries(infos []os.FileInfo) []iofs.DirEntry {
+	entries := make([]iofs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = iofs.FileInfoToDirEntry(info)
+	}
+	return entries
 }
 
 func (f *zipFile) Seek(offset int64, whence int) (int64, error) {
-	return 0, nil
+	if f.isDir {
+		return 0, errors.New("zipfs: cannot seek a directory")
+	}
+
+	size := int64(f.file.UncompressedSize64)
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = f.pos + offset
+	case io.SeekEnd:
+		newPos = size + offset
+	default:
+		return 0, errors.New("zipfs: invalid whence")
+	}
+	if newPos < 0 {
+		return 0, errors.New("zipfs: negative position")
+	}
+	if newPos > size {
+		return 0, errors.New("zipfs: seek beyond end of file")
+	}
+
+	// Store'd entries are uncompressed, so the raw bytes in the archive are
+	// the file's contents and a SectionReader gives us O(1) seeks.
+	if f.file.Method == zip.Store {
+		if f.raw == nil {
+			r, err := f.file.OpenRaw()
+			if err != nil {
+				return 0, err
+			}
+			sr, ok := r.(*io.SectionReader)
+			if !ok {
+				return 0, errors.New("zipfs: unexpected raw reader type")
+			}
+			f.raw = sr
+		}
+		f.pos = newPos
+		return f.pos, nil
+	}
+
+	if newPos >= f.pos {
+		if err := f.discard(newPos - f.pos); err != nil {
+			return 0, err
+		}
+	} else {
+		if f.rc != nil {
+			_ = f.rc.Close()
+			f.rc = nil
+		}
+		f.pos = 0
+		if err := f.discard(newPos); err != nil {
+			return 0, err
+		}
+	}
+	return f.pos, nil
+}
+
+// discard advances the decompressed stream by n bytes, opening the entry
+// first if necessary.
+func (f *zipFile) discard(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if f.rc == nil {
+		rc, err := f.file.Open()
+		if err != nil {
+			return err
+		}
+		f.rc = rc
+	}
+	copied, err := io.CopyN(io.Discard, f.rc, n)
+	f.pos += copied
+	return err
 }
 
 func (f *zipFile) Stat() (os.FileInfo, error) {
@@ -174,23 +561,35 @@ func (f *zipFile) Stat() (os.FileInfo, error) {
 }
 
 func (f *zipFile) Name() string {
+	if f.isDir {
+		return f.name
+	}
 	return f.file.Name
 }
 
 func (f *zipFile) Size() int64 {
+	if f.isDir {
+		return 0
+	}
 	return int64(f.file.UncompressedSize64)
 }
 
 func (f *zipFile) Mode() os.FileMode {
+	if f.isDir {
+		return os.ModeDir | 0555
+	}
 	return f.file.Mode()
 }
 
 func (f *zipFile) ModTime() time.Time {
+	if f.isDir {
+		return time.Time{}
+	}
 	return f.file.ModTime()
 }
 
 func (f *zipFile) IsDir() bool {
-	return false
+	return f.isDir
 }
 
 func (f *zipFile) Sys() interface{} {
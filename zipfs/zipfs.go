@@ -2,25 +2,46 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"go/parser"
 	"go/token"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 var commentPattern = regexp.MustCompile(`zipfs:(\S+)\s+(\S+)((?:\s+-x\s*\S+)*)`)
 var excludePattern = regexp.MustCompile(`-x\s*(\S+)`)
 
+// parallelThreshold is the uncompressed file size above which appendZipData
+// compresses a file's blocks concurrently instead of with a single
+// flate.Writer.
+const parallelThreshold = 6 * 1024 * 1024
+
+// blockSize is the size of the chunks a large file is split into for
+// parallel DEFLATE, matching the block size used by Android Soong's zip
+// writer.
+const blockSize = 1 * 1024 * 1024
+
 func main() {
 	var sourceDir string
+	var jobs int
 
 	flag.StringVar(&sourceDir, "src", "", "Root source directory")
+	flag.IntVar(&jobs, "j", runtime.GOMAXPROCS(0), "Number of workers used to compress large files in parallel")
 	flag.Usage = func() {
 		fmt.Printf("Usage: %s [options] <executable-file>\n", filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
@@ -41,8 +62,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	if jobs < 1 {
+		jobs = 1
+	}
+
 	sourceDir = getSourceDir(sourceDir)
-	parseTree(sourceDir, exePath)
+	parseTree(sourceDir, exePath, jobs)
 }
 
 func getSourceDir(srcDir string) string {
@@ -74,7 +99,7 @@ func getSourceDir(srcDir string) string {
 	return ""
 }
 
-func parseTree(dir string, exePath string) {
+func parseTree(dir string, exePath string, jobs int) {
 	exeName := filepath.Base(exePath)
 	exeName = strings.TrimSuffix(exeName, filepath.Ext(exeName))
 
@@ -89,7 +114,7 @@ func parseTree(dir string, exePath string) {
 			for _, s := range file.Comments {
 				for _, cmt := range s.List {
 					if strings.HasPrefix(cmt.Text, "//") {
-						handleComment(cmt.Text, path, exePath)
+						handleComment(cmt.Text, path, exePath, jobs)
 					}
 				}
 			}
@@ -98,7 +123,7 @@ func parseTree(dir string, exePath string) {
 	})
 }
 
-func handleComment(comment string, filePath string, exePath string) {
+func handleComment(comment string, filePath string, exePath string, jobs int) {
 	matches := commentPattern.FindStringSubmatch(comment)
 	if matches != nil {
 		collectionName := matches[1]
@@ -122,7 +147,7 @@ func handleComment(comment string, filePath string, exePath string) {
 
 		fmt.Printf("Collection \"%s\":\n", collectionName)
 
-		err := appendZipData(exePath, collectionName, dataDir, excludes)
+		err := appendZipData(exePath, collectionName, dataDir, excludes, jobs)
 		if err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "ERROR: Could not append zip data: %s\n", err)
 			os.Exit(1)
@@ -144,29 +169,14 @@ func hasZipData(exePath string) bool {
 	return string(data) == "ZIPR"
 }
 
-func appendZipData(exePath string, collectionName string, dataDir string, excludes []string) error {
+func appendZipData(exePath string, collectionName string, dataDir string, excludes []string, jobs int) error {
 	dataDir, err := filepath.Abs(dataDir)
 	if err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(exePath, os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = file.Close()
-	}()
-
-	offset, err := file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
-	}
-
-	_, _ = file.WriteString(collectionName)
-	_, _ = file.Write([]byte{0})
-
-	zipWriter := zip.NewWriter(file)
+	var zipData bytes.Buffer
+	zipWriter := zip.NewWriter(&zipData)
 
 	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -188,14 +198,19 @@ func appendZipData(exePath string, collectionName string, dataDir string, exclud
 				}
 			}
 
-			if include {
-				fmt.Println("- " + relPath)
-
-				reader, err := os.Open(path)
+			if include && info.Mode()&os.ModeSymlink != 0 {
+				target, err := filepath.EvalSymlinks(path)
 				if err != nil {
 					return err
 				}
-				defer reader.Close()
+				if target != dataDir && !strings.HasPrefix(target, dataDir+string(filepath.Separator)) {
+					fmt.Println("- " + relPath + " (skipped: symlink escapes " + dataDir + ")")
+					include = false
+				}
+			}
+
+			if include {
+				fmt.Println("- " + relPath)
 
 				header, err := zip.FileInfoHeader(stat)
 				if err != nil {
@@ -203,14 +218,42 @@ func appendZipData(exePath string, collectionName string, dataDir string, exclud
 				}
 				header.Name = relPath
 
-				writer, err := zipWriter.CreateHeader(header)
-				if err != nil {
-					return err
-				}
+				if stat.Size() > parallelThreshold {
+					compressed, crc, err := compressFileParallel(path, jobs)
+					if err != nil {
+						return err
+					}
 
-				_, err = io.Copy(writer, reader)
-				if err != nil {
-					return err
+					header.Method = zip.Deflate
+					header.CRC32 = crc
+					header.UncompressedSize64 = uint64(stat.Size())
+					header.CompressedSize64 = uint64(len(compressed))
+
+					writer, err := zipWriter.CreateRaw(header)
+					if err != nil {
+						return err
+					}
+
+					_, err = writer.Write(compressed)
+					if err != nil {
+						return err
+					}
+				} else {
+					reader, err := os.Open(path)
+					if err != nil {
+						return err
+					}
+					defer reader.Close()
+
+					writer, err := zipWriter.CreateHeader(header)
+					if err != nil {
+						return err
+					}
+
+					_, err = io.Copy(writer, reader)
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -223,9 +266,574 @@ func appendZipData(exePath string, collectionName string, dataDir string, exclud
 		return err
 	}
 
-	_ = zipWriter.Close()
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+
+	payload := append([]byte("ZIPR"+collectionName+"\x00"), zipData.Bytes()...)
+
+	ok, err := appendSection(exePath, payload)
+	if !ok && err != nil {
+		return err
+	}
+	if ok && err == nil {
+		return nil
+	}
+
+	return appendTail(exePath, collectionName, zipData.Bytes())
+}
+
+// appendTail appends a collection after the executable's natural end,
+// chaining it to any previously appended collection via an 8 byte trailer:
+// the tag "ZIPR" followed by the big-endian file offset of this
+// collection's name and zip data. This is the original zipfs embedding
+// technique; it is used whenever the executable format isn't recognized by
+// appendSection, or the section couldn't be written to.
+func appendTail(exePath string, collectionName string, zipData []byte) error {
+	file, err := os.OpenFile(exePath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, _ = file.WriteString(collectionName)
+	_, _ = file.Write([]byte{0})
+	_, _ = file.Write(zipData)
 	_, _ = file.WriteString("ZIPR")
 	_ = binary.Write(file, binary.BigEndian, int32(offset))
 
 	return nil
 }
+
+// appendSection tries to embed payload (already framed as
+// "ZIPR"<name>"\x00"<zip bytes>) in a dedicated section of exePath, using
+// the executable's own format, so the collection survives tools that
+// rewrite or strip data appended to the tail (notably macOS codesign and
+// Windows Authenticode). It reports ok=false, with no error, when the
+// executable format isn't one appendSection knows how to patch, so the
+// caller can fall back to appendTail.
+func appendSection(exePath string, payload []byte) (ok bool, err error) {
+	probe, err := os.Open(exePath)
+	if err != nil {
+		return false, err
+	}
+
+	var format string
+	if _, err := elf.NewFile(probe); err == nil {
+		format = "elf"
+	} else if _, err := pe.NewFile(probe); err == nil {
+		format = "pe"
+	} else if _, err := macho.NewFile(probe); err == nil {
+		format = "macho"
+	}
+	_ = probe.Close()
+
+	switch format {
+	case "elf":
+		return true, appendELFSection(exePath, payload)
+	case "pe":
+		return true, appendPESection(exePath, payload)
+	case "macho":
+		return true, appendMachOSection(exePath, payload)
+	default:
+		return false, nil
+	}
+}
+
+// appendELFSection appends payload to exePath and adds a new, non-loaded
+// ".zipfs" PROGBITS section describing it, by growing the section header
+// table and patching e_shoff/e_shnum in the ELF header. Only 64-bit ELF is
+// supported; 32-bit binaries fall back to appendTail.
+func appendELFSection(exePath string, payload []byte) error {
+	file, err := os.OpenFile(exePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ident := make([]byte, 16)
+	if _, err := file.ReadAt(ident, 0); err != nil {
+		return err
+	}
+	if ident[elf.EI_CLASS] != byte(elf.ELFCLASS64) {
+		return errors.New("zipfs: 32-bit ELF section embedding is not supported")
+	}
+
+	order := binary.ByteOrder(binary.LittleEndian)
+	if ident[elf.EI_DATA] == byte(elf.ELFDATA2MSB) {
+		order = binary.BigEndian
+	}
+
+	var ehdr struct {
+		_         [16]byte
+		Type      uint16
+		Machine   uint16
+		Version   uint32
+		Entry     uint64
+		Phoff     uint64
+		Shoff     uint64
+		Flags     uint32
+		Ehsize    uint16
+		Phentsize uint16
+		Phnum     uint16
+		Shentsize uint16
+		Shnum     uint16
+		Shstrndx  uint16
+	}
+	if err := binary.Read(io.NewSectionReader(file, 0, 64), order, &ehdr); err != nil {
+		return err
+	}
+
+	headerTable := make([]byte, int(ehdr.Shnum)*int(ehdr.Shentsize))
+	if _, err := file.ReadAt(headerTable, int64(ehdr.Shoff)); err != nil {
+		return err
+	}
+
+	// The new section's Name is an index into the section header string
+	// table (.shstrtab), the section e_shstrndx points at. Grow a copy of
+	// that table with the ".zipfs\0" name rather than editing it in place,
+	// since there's no room guaranteed after its existing bytes.
+	shstrEntry := headerTable[int(ehdr.Shstrndx)*int(ehdr.Shentsize):]
+	oldStrtabOffset := order.Uint64(shstrEntry[24:32])
+	oldStrtabSize := order.Uint64(shstrEntry[32:40])
+	oldStrtab := make([]byte, oldStrtabSize)
+	if _, err := file.ReadAt(oldStrtab, int64(oldStrtabOffset)); err != nil {
+		return err
+	}
+	nameOffset := len(oldStrtab)
+	newStrtab := append(oldStrtab, append([]byte(".zipfs"), 0)...)
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	payloadOffset := stat.Size()
+	if _, err := file.WriteAt(payload, payloadOffset); err != nil {
+		return err
+	}
+
+	strtabOffset := payloadOffset + int64(len(payload))
+	if _, err := file.WriteAt(newStrtab, strtabOffset); err != nil {
+		return err
+	}
+	order.PutUint64(shstrEntry[24:32], uint64(strtabOffset))
+	order.PutUint64(shstrEntry[32:40], uint64(len(newStrtab)))
+
+	var newSection struct {
+		Name      uint32
+		Type      uint32
+		Flags     uint64
+		Addr      uint64
+		Offset    uint64
+		Size      uint64
+		Link      uint32
+		Info      uint32
+		AddrAlign uint64
+		EntSize   uint64
+	}
+	newSection.Name = uint32(nameOffset)
+	newSection.Type = uint32(elf.SHT_PROGBITS)
+	newSection.Offset = uint64(payloadOffset)
+	newSection.Size = uint64(len(payload))
+	newSection.AddrAlign = 1
+
+	var newEntry bytes.Buffer
+	if err := binary.Write(&newEntry, order, &newSection); err != nil {
+		return err
+	}
+
+	newShoff := strtabOffset + int64(len(newStrtab))
+	if _, err := file.WriteAt(append(headerTable, newEntry.Bytes()...), newShoff); err != nil {
+		return err
+	}
+
+	shoffBuf := make([]byte, 8)
+	order.PutUint64(shoffBuf, uint64(newShoff))
+	if _, err := file.WriteAt(shoffBuf, 0x28); err != nil {
+		return err
+	}
+
+	shnumBuf := make([]byte, 2)
+	order.PutUint16(shnumBuf, ehdr.Shnum+1)
+	if _, err := file.WriteAt(shnumBuf, 0x3c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// appendPESection appends payload to exePath and adds a new ".zipfs"
+// section describing it, by growing the section table in place. This only
+// succeeds when the existing header padding between the section table and
+// the first section's raw data leaves room for one more 40 byte section
+// header; otherwise it returns an error so the caller falls back to
+// appendTail.
+func appendPESection(exePath string, payload []byte) error {
+	const fileAlignment = 512
+
+	file, err := os.OpenFile(exePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lfanew := make([]byte, 4)
+	if _, err := file.ReadAt(lfanew, 0x3c); err != nil {
+		return err
+	}
+	peOffset := int64(binary.LittleEndian.Uint32(lfanew))
+
+	fileHeader := make([]byte, 20)
+	if _, err := file.ReadAt(fileHeader, peOffset+4); err != nil {
+		return err
+	}
+	numSections := binary.LittleEndian.Uint16(fileHeader[2:4])
+	sizeOptHeader := binary.LittleEndian.Uint16(fileHeader[16:18])
+
+	sectionTableOffset := peOffset + 4 + 20 + int64(sizeOptHeader)
+	headerTable := make([]byte, int(numSections)*40)
+	if _, err := file.ReadAt(headerTable, sectionTableOffset); err != nil {
+		return err
+	}
+
+	var firstRawData int64
+	for i := 0; i < int(numSections); i++ {
+		entry := headerTable[i*40 : i*40+40]
+		rawData := int64(binary.LittleEndian.Uint32(entry[20:24]))
+		if rawData > 0 && (firstRawData == 0 || rawData < firstRawData) {
+			firstRawData = rawData
+		}
+	}
+
+	headerEnd := sectionTableOffset + int64(len(headerTable))
+	if firstRawData-headerEnd < 40 {
+		return errors.New("zipfs: no room to add a PE section header")
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	payloadOffset := stat.Size()
+	paddedOffset := (payloadOffset + fileAlignment - 1) / fileAlignment * fileAlignment
+	if _, err := file.WriteAt(payload, paddedOffset); err != nil {
+		return err
+	}
+	paddedSize := (int64(len(payload)) + fileAlignment - 1) / fileAlignment * fileAlignment
+
+	var newEntry [40]byte
+	copy(newEntry[0:8], ".zipfs")
+	binary.LittleEndian.PutUint32(newEntry[8:12], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(newEntry[16:20], uint32(paddedSize))
+	binary.LittleEndian.PutUint32(newEntry[20:24], uint32(paddedOffset))
+	binary.LittleEndian.PutUint32(newEntry[36:40], 0x40000040) // IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ
+
+	if _, err := file.WriteAt(newEntry[:], headerEnd); err != nil {
+		return err
+	}
+
+	numSectionsBuf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(numSectionsBuf, numSections+1)
+	if _, err := file.WriteAt(numSectionsBuf, peOffset+4+2); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// appendMachOSection appends payload to exePath and adds a new
+// "__zipfs,__zipfs" 64-bit section describing it, by growing the load
+// command area in place. This only succeeds when the gap between the
+// existing load commands and the first segment's file data leaves room for
+// a full LC_SEGMENT_64 command (with one section); otherwise it returns an
+// error so the caller falls back to appendTail.
+func appendMachOSection(exePath string, payload []byte) error {
+	const segmentCommandSize = 72 // sizeof(mach_header_64.segment_command_64)
+	const sectionSize = 80        // sizeof(mach_header_64.section_64)
+	const lcSegment64 = 0x19
+
+	file, err := os.OpenFile(exePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xfeedfacf: // MH_MAGIC_64
+		order = binary.LittleEndian
+	case 0xcffaedfe: // MH_CIGAM_64
+		order = binary.BigEndian
+	default:
+		return errors.New("zipfs: only 64-bit Mach-O is supported for section embedding")
+	}
+
+	header := make([]byte, 32)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	ncmds := order.Uint32(header[16:20])
+	sizeofcmds := order.Uint32(header[20:24])
+
+	loadCommandsEnd := int64(32) + int64(sizeofcmds)
+
+	firstFileOff, err := firstMachOSegmentFileOffset(file, order, int(ncmds), int64(32))
+	if err != nil {
+		return err
+	}
+
+	newCmdSize := int64(segmentCommandSize + sectionSize)
+	if firstFileOff-loadCommandsEnd < newCmdSize {
+		return errors.New("zipfs: no room to add a Mach-O load command")
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	payloadOffset := stat.Size()
+	if _, err := file.WriteAt(payload, payloadOffset); err != nil {
+		return err
+	}
+
+	cmd := make([]byte, newCmdSize)
+	order.PutUint32(cmd[0:4], lcSegment64)
+	order.PutUint32(cmd[4:8], uint32(newCmdSize))
+	copy(cmd[8:24], "__zipfs")
+	// vmaddr, vmsize left zero: this segment carries no loadable memory.
+	order.PutUint64(cmd[40:48], uint64(payloadOffset))
+	order.PutUint64(cmd[48:56], uint64(len(payload)))
+	order.PutUint32(cmd[64:68], 1) // nsects
+
+	// section_64: sectname[16] segname[16] addr(8) size(8) offset(4) ...
+	// addr is left zero since this section carries no loadable memory.
+	section := cmd[segmentCommandSize:]
+	copy(section[0:16], "__zipfs")
+	copy(section[16:32], "__zipfs")
+	order.PutUint64(section[40:48], uint64(len(payload)))
+	order.PutUint32(section[48:52], uint32(payloadOffset))
+
+	if _, err := file.WriteAt(cmd, loadCommandsEnd); err != nil {
+		return err
+	}
+
+	ncmdsBuf := make([]byte, 4)
+	order.PutUint32(ncmdsBuf, ncmds+1)
+	if _, err := file.WriteAt(ncmdsBuf, 16); err != nil {
+		return err
+	}
+
+	sizeofcmdsBuf := make([]byte, 4)
+	order.PutUint32(sizeofcmdsBuf, sizeofcmds+uint32(newCmdSize))
+	if _, err := file.WriteAt(sizeofcmdsBuf, 20); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// firstMachOSegmentFileOffset returns the lowest non-zero file offset among
+// the existing LC_SEGMENT_64 commands' sections, i.e. where the first
+// segment's raw data begins.
+func firstMachOSegmentFileOffset(file *os.File, order binary.ByteOrder, ncmds int, start int64) (int64, error) {
+	const lcSegment64 = 0x19
+
+	offset := start
+	var first int64
+	for i := 0; i < ncmds; i++ {
+		cmdHeader := make([]byte, 8)
+		if _, err := file.ReadAt(cmdHeader, offset); err != nil {
+			return 0, err
+		}
+		cmd := order.Uint32(cmdHeader[0:4])
+		cmdSize := order.Uint32(cmdHeader[4:8])
+
+		if cmd == lcSegment64 {
+			body := make([]byte, cmdSize)
+			if _, err := file.ReadAt(body, offset); err != nil {
+				return 0, err
+			}
+			nsects := order.Uint32(body[64:68])
+			for s := 0; s < int(nsects); s++ {
+				sec := body[72+s*80 : 72+(s+1)*80]
+				fileOff := int64(order.Uint32(sec[48:52]))
+				if fileOff > 0 && (first == 0 || fileOff < first) {
+					first = fileOff
+				}
+			}
+		}
+
+		offset += int64(cmdSize)
+	}
+
+	if first == 0 {
+		return 0, errors.New("zipfs: could not determine Mach-O data start")
+	}
+	return first, nil
+}
+
+// compressFileParallel DEFLATEs the file at path one blockSize chunk at a
+// time, farming the chunks out to a pool of jobs workers, and returns the
+// concatenated raw compressed stream together with the CRC32 of the whole
+// file. Every chunk but the last is compressed with its own flate.Writer and
+// sync-flushed rather than closed, so the individual streams join into a
+// single valid DEFLATE stream once concatenated; only the final chunk emits
+// the terminating block.
+func compressFileParallel(path string, jobs int) ([]byte, uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var blocks [][]byte
+	for {
+		block := make([]byte, blockSize)
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			blocks = append(blocks, block[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(blocks) == 0 {
+		blocks = append(blocks, nil)
+	}
+
+	compressed := make([][]byte, len(blocks))
+	crcs := make([]uint32, len(blocks))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	errs := make(chan error, len(blocks))
+
+	for i, block := range blocks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, block []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var buf bytes.Buffer
+			w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := w.Write(block); err != nil {
+				errs <- err
+				return
+			}
+			if i == len(blocks)-1 {
+				err = w.Close()
+			} else {
+				err = w.Flush()
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			compressed[i] = buf.Bytes()
+			crcs[i] = crc32.ChecksumIEEE(block)
+		}(i, block)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var out bytes.Buffer
+	var crc uint32
+	for i, c := range compressed {
+		out.Write(c)
+		if i == 0 {
+			crc = crcs[i]
+		} else {
+			crc = crc32Combine(crc32.IEEE, crc, crcs[i], int64(len(blocks[i])))
+		}
+	}
+
+	return out.Bytes(), crc, nil
+}
+
+// crc32Combine computes the CRC32 (for the polynomial identified by poly,
+// e.g. crc32.IEEE) of two byte sequences concatenated together, given only
+// the CRC32 of each sequence and the length of the second one. This is the
+// standard GF(2) matrix technique used by zlib's crc32_combine, and lets
+// compressFileParallel merge the per-block checksums it computed
+// concurrently without rehashing the whole file.
+func crc32Combine(poly uint32, crc1 uint32, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	var even, odd [32]uint32
+
+	// odd holds the matrix for a single zero bit.
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(&even, &odd) // even: two zero bits
+	gf2MatrixSquare(&odd, &even) // odd: four zero bits
+
+	result := crc1
+	for len2 > 0 {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			result = gf2MatrixTimes(&even, result)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			result = gf2MatrixTimes(&odd, result)
+		}
+		len2 >>= 1
+	}
+
+	return result ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for n := 0; vec != 0; n++ {
+		if vec&1 != 0 {
+			sum ^= mat[n]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square *[32]uint32, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestAppendELFSectionRoundTrip guards against a regression where the new
+// section's sh_name was left at zero: the section existed in the table but
+// resolved to an empty name in .shstrtab, so sectionLocator (zipfs.go) could
+// never find it by name and the embedded collection was silently
+// unreachable at runtime.
+func TestAppendELFSectionRoundTrip(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ELF section embedding is only exercised on linux")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+
+	exePath := filepath.Join(t.TempDir(), "exe")
+	if err := copyFile(self, exePath); err != nil {
+		t.Fatalf("copyFile: %v", err)
+	}
+
+	payload := []byte("ZIPRtestcol\x00hello zip data")
+	if err := appendELFSection(exePath, payload); err != nil {
+		t.Fatalf("appendELFSection: %v", err)
+	}
+
+	f, err := elf.Open(exePath)
+	if err != nil {
+		t.Fatalf("elf.Open: %v", err)
+	}
+	defer f.Close()
+
+	sec := f.Section(".zipfs")
+	if sec == nil {
+		t.Fatal("no .zipfs section found; sh_name was not patched")
+	}
+	got, err := sec.Data()
+	if err != nil {
+		t.Fatalf("section.Data: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("section content = %q, want %q", got, payload)
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,266 @@
+package zipfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildZip writes a zip archive containing the given entries (name to
+// content) and returns a *zip.Reader over it. Names in storeAsIs are written
+// with zip.Store so Seek's O(1) SectionReader path can be exercised; all
+// others are written with the default Deflate method.
+func buildZip(t *testing.T, entries map[string]string, storeAsIs map[string]bool) *zip.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range entries {
+		method := zip.Deflate
+		if storeAsIs[name] {
+			method = zip.Store
+		}
+		hdr := &zip.FileHeader{Name: name, Method: method}
+		fw, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q): %v", name, err)
+		}
+		if _, err := fw.Write([]byte(content)); err != nil {
+			t.Fatalf("Write(%q): %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("zip.Writer.Close: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	return zr
+}
+
+func TestValidEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"", false},
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{"/etc/passwd", false},
+		{"../evil.txt", false},
+		{"dir/../../evil.txt", false},
+		{"dir/./a.txt", false},
+		{`sub\evil.txt`, false},
+		{"has\x00null", false},
+	}
+	for _, tt := range tests {
+		if got := validEntryName(tt.name); got != tt.want {
+			t.Errorf("validEntryName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestZipFSOpenFilesAndDirs(t *testing.T) {
+	zr := buildZip(t, map[string]string{
+		"index.html":    "<html></html>",
+		"dir/a.txt":     "a",
+		"dir/sub/b.txt": "b",
+	}, nil)
+	fs := newZipFS(zr)
+
+	f, err := fs.Open("index.html")
+	if err != nil {
+		t.Fatalf("Open(index.html): %v", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "<html></html>" {
+		t.Errorf("content = %q", data)
+	}
+	f.Close()
+
+	root, err := fs.Open(".")
+	if err != nil {
+		t.Fatalf("Open(.): %v", err)
+	}
+	entries, err := root.(iofs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatalf("ReadDir(root): %v", err)
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	if !names["index.html"] || !names["dir"] {
+		t.Errorf("root listing = %v, want index.html and dir", names)
+	}
+
+	dir, err := fs.Open("dir")
+	if err != nil {
+		t.Fatalf("Open(dir): %v", err)
+	}
+	if !dir.(iofs.FileInfo).IsDir() {
+		t.Error("dir should report IsDir")
+	}
+
+	if _, err := fs.Open("does/not/exist"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Open(missing) err = %v, want ErrNotExist", err)
+	}
+}
+
+func TestZipFSInsecureEntries(t *testing.T) {
+	zr := buildZip(t, map[string]string{
+		"index.html":  "ok",
+		"../evil.txt": "bad",
+	}, nil)
+	fs := newZipFS(zr)
+
+	// A request for the exact excluded entry surfaces ErrInsecurePath.
+	if _, err := fs.Open("../evil.txt"); !errors.Is(err, ErrInsecurePath) {
+		t.Errorf("Open(../evil.txt) err = %v, want ErrInsecurePath", err)
+	}
+
+	// Regression: an unrelated, perfectly valid path must never fail because
+	// some other entry in the archive was insecure, no matter how many times
+	// or in what order it's requested.
+	for i := 0; i < 3; i++ {
+		f, err := fs.Open("index.html")
+		if err != nil {
+			t.Fatalf("Open(index.html) #%d: %v", i, err)
+		}
+		f.Close()
+	}
+
+	// The insecure entry must not show up in a directory listing either.
+	root, err := fs.Open(".")
+	if err != nil {
+		t.Fatalf("Open(.): %v", err)
+	}
+	entries, err := root.(iofs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatalf("ReadDir(root): %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() == "evil.txt" {
+			t.Errorf("insecure entry leaked into directory listing: %v", entries)
+		}
+	}
+}
+
+func TestZipFileSeek(t *testing.T) {
+	content := "0123456789"
+	zr := buildZip(t, map[string]string{
+		"stored.txt":   content,
+		"deflated.txt": content,
+	}, map[string]bool{"stored.txt": true})
+	fs := newZipFS(zr)
+
+	for _, name := range []string{"stored.txt", "deflated.txt"} {
+		t.Run(name, func(t *testing.T) {
+			f, err := fs.Open(name)
+			if err != nil {
+				t.Fatalf("Open(%q): %v", name, err)
+			}
+			defer f.Close()
+			seeker := f.(io.Seeker)
+
+			pos, err := seeker.Seek(5, io.SeekStart)
+			if err != nil || pos != 5 {
+				t.Fatalf("Seek(5, Start) = %d, %v", pos, err)
+			}
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				t.Fatalf("ReadFull: %v", err)
+			}
+			if string(buf) != "56" {
+				t.Errorf("content at offset 5 = %q, want 56", buf)
+			}
+
+			if _, err := seeker.Seek(-7, io.SeekCurrent); err != nil {
+				t.Fatalf("Seek(-7, Current): %v", err)
+			}
+			if _, err := io.ReadFull(f, buf); err != nil {
+				t.Fatalf("ReadFull after backward seek: %v", err)
+			}
+			if string(buf) != "01" {
+				t.Errorf("content after backward seek = %q, want 01", buf)
+			}
+
+			if _, err := seeker.Seek(int64(len(content)+1), io.SeekStart); err == nil {
+				t.Error("Seek past end of file should fail")
+			}
+			if _, err := seeker.Seek(-1, io.SeekStart); err == nil {
+				t.Error("Seek to negative position should fail")
+			}
+		})
+	}
+}
+
+func TestZipFileReadDirPaging(t *testing.T) {
+	zr := buildZip(t, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+		"c.txt": "c",
+	}, nil)
+	fs := newZipFS(zr)
+
+	f, err := fs.Open(".")
+	if err != nil {
+		t.Fatalf("Open(.): %v", err)
+	}
+	rdf := f.(iofs.ReadDirFile)
+
+	first, err := rdf.ReadDir(2)
+	if err != nil {
+		t.Fatalf("ReadDir(2): %v", err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("len(first) = %d, want 2", len(first))
+	}
+
+	rest, err := rdf.ReadDir(2)
+	if err != nil {
+		t.Fatalf("ReadDir(2) #2: %v", err)
+	}
+	if len(rest) != 1 {
+		t.Fatalf("len(rest) = %d, want 1", len(rest))
+	}
+
+	if _, err := rdf.ReadDir(2); err != io.EOF {
+		t.Errorf("ReadDir at end = %v, want io.EOF", err)
+	}
+}
+
+func TestNewFSDevModeFallback(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	fsys := NewFS("no-such-collection", dir)
+
+	data, err := iofs.ReadFile(fsys, "hello.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != "hi" {
+		t.Errorf("content = %q, want hi", data)
+	}
+
+	info, err := iofs.Stat(fsys, "hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.IsDir() {
+		t.Error("hello.txt should not be a directory")
+	}
+}